@@ -301,7 +301,7 @@ func transferPubKey(ds dstore.Datastore, oldk dstore.Key, data []byte, mkKey mkK
 
 func transferIpnsEntries(ds dstore.Datastore, oldk dstore.Key, data []byte, mkkey mkKeyFunc) error {
 	if len(oldk.String()) != 40 {
-		log.Log(" - skipping malformed ipns record: %q", oldk)
+		log.Warn("skipping malformed ipns record: %q", oldk)
 		return nil
 	}
 	dsk := dstore.NewKey("/ipns/" + base32.RawStdEncoding.EncodeToString([]byte(oldk.String()[6:])))
@@ -310,7 +310,7 @@ func transferIpnsEntries(ds dstore.Datastore, oldk dstore.Key, data []byte, mkke
 
 func revertIpnsEntries(ds dstore.Datastore, oldk dstore.Key, data []byte, mkkey mkKeyFunc) error {
 	if len(oldk.String()) != 61 {
-		log.Log(" - skipping malformed ipns record: %q", oldk)
+		log.Warn("skipping malformed ipns record: %q", oldk)
 		return nil
 	}
 	dec, err := base32.RawStdEncoding.DecodeString(oldk.String()[6:])
@@ -348,7 +348,7 @@ func transferBlocks(flatfsdir string) error {
 
 		rel := p[len(flatfsdir)+1:]
 		if !strings.HasSuffix(rel, ".data") {
-			fmt.Println("skipping (no .data): ", rel)
+			log.Warn("skipping (no .data): ", rel)
 			return nil
 		}
 
@@ -371,7 +371,7 @@ func transferBlocks(flatfsdir string) error {
 		_, fi := filepath.Split(rel[:len(rel)-5])
 		k, err := hex.DecodeString(fi)
 		if err != nil {
-			fmt.Printf("failed to decode: %s\n", p)
+			log.Error("failed to decode: %s", p)
 			return err
 		}
 
@@ -404,7 +404,7 @@ func transferBlocks(flatfsdir string) error {
 
 	err := cleanEmptyDirs(flatfsdir)
 	if err != nil {
-		fmt.Println(err)
+		log.Warn("failed to clean empty directories: %s", err)
 	}
 
 	return nil
@@ -76,7 +76,7 @@ func convert(in io.Reader, out io.Writer, convFunc convFunc) error {
 	if bootstrapi == nil {
 		bootstrapi, _ := confMap["bootstrap"].([]interface{})
 		if bootstrapi == nil {
-			log.Log("Bootstrap field missing or of the wrong type")
+			log.Warn("Bootstrap field missing or of the wrong type")
 			log.Log("Nothing to migrate")
 			_, err := out.Write(data)
 			return err
@@ -2,11 +2,14 @@ package mg8
 
 import (
 	base32 "encoding/base32"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	migrate "github.com/ipfs/fs-repo-migrations/go-migrate"
 	mfsr "github.com/ipfs/fs-repo-migrations/mfsr"
@@ -15,14 +18,33 @@ import (
 
 type Migration struct{}
 
+// The repo versions this migration moves between.
+const (
+	fromVersion = "8"
+	toVersion   = "9"
+)
+
 func (m Migration) Versions() string {
-	return "8-to-9"
+	return fromVersion + "-to-" + toVersion
 }
 
 func (m Migration) Reversible() bool {
 	return true
 }
 
+// NeedsMigration reports whether the repo at opts.Path is at version 8 and
+// so needs this migration applied. Like Apply and Revert it resolves
+// symlinks in the path, and it only reads the version file.
+func (m Migration) NeedsMigration(opts migrate.Options) (bool, error) {
+	log.Verbose = opts.Verbose
+
+	_, v, err := resolveRepoPath(opts.Path)
+	if err != nil {
+		return false, err
+	}
+	return v == fromVersion, nil
+}
+
 const keyFilenamePrefix = "key_"
 
 const keystoreRoot = "keystore"
@@ -54,11 +76,139 @@ func decode(name string) (string, error) {
 	return string(data), err
 }
 
+// resolveRepoPath follows any symlinks in the given repo path, so that the
+// keystore and the version file are looked up in the same place, and checks
+// that the resolved directory has both of them and that the version is a
+// number. It returns the resolved path and the repo version read from it.
+func resolveRepoPath(p string) (string, string, error) {
+	resolved, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return "", "", err
+	}
+	log.VLog("repo path %s resolves to %s", p, resolved)
+
+	rp := mfsr.RepoPath(resolved)
+	v, err := rp.Version()
+	if err != nil {
+		return "", "", err
+	}
+	if _, err := strconv.Atoi(v); err != nil {
+		return "", "", fmt.Errorf("invalid version %q in %s", v, rp.VersionFile())
+	}
+
+	fi, err := os.Stat(filepath.Join(resolved, keystoreRoot))
+	if os.IsNotExist(err) || (err == nil && !fi.IsDir()) {
+		return "", "", fmt.Errorf("no %s directory in repo at %s", keystoreRoot, resolved)
+	}
+	if err != nil {
+		return "", "", err
+	}
+	return resolved, v, nil
+}
+
+// writeVersionFile writes the repo version file. It writes and syncs a
+// temporary file and renames it over the version file, so that a crash
+// leaves either the old or the new version in place, never a truncated
+// file. Tests replace it to simulate a failed write.
+var writeVersionFile = func(rp mfsr.RepoPath, version string) error {
+	fn := rp.VersionFile()
+	tmp, err := ioutil.TempFile(filepath.Dir(fn), mfsr.VersionFile+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(version + "\n"); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fn)
+}
+
+// writeVersion writes the repo version file and reads it back to check that
+// it holds the expected version. The write is synced before it is read back,
+// see writeVersionFile.
+//
+// Apply and Revert rename the keystore files first and write the version
+// last. If the version write fails, the repo is left at its old version with
+// the keys renamed, and running the same direction again is safe because
+// encodeDecode skips names that are already in the target format.
+func writeVersion(repoPath string, version string) error {
+	rp := mfsr.RepoPath(repoPath)
+	if err := writeVersionFile(rp, version); err != nil {
+		return err
+	}
+	return rp.CheckVersion(version)
+}
+
+// versionTransition is the audit record logged for each version file change.
+type versionTransition struct {
+	Repo      string    `json:"repo"`
+	Migration string    `json:"migration"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Time      time.Time `json:"time"`
+}
+
+// logVersionTransition logs a single-line JSON record of a version file
+// change, so the move between versions can be audited from the log.
+func (m Migration) logVersionTransition(repoPath string, from string, to string) {
+	rec, err := json.Marshal(versionTransition{
+		Repo:      repoPath,
+		Migration: m.Versions(),
+		From:      from,
+		To:        to,
+		Time:      time.Now().UTC(),
+	})
+	if err != nil {
+		log.Error("failed to encode version transition: ", err)
+		return
+	}
+	log.Log("version transition: %s", rec)
+}
+
+// checkStartVersion checks, before any keystore file is renamed, that the
+// repo is at the version the migration starts from. -f skips the check.
+func checkStartVersion(opts migrate.Options, actual string, expected string) error {
+	if actual == expected {
+		return nil
+	}
+	if opts.Force {
+		log.Warn("repo is at version %s, expected %s, continuing anyway", actual, expected)
+		return nil
+	}
+	return fmt.Errorf("repo is at version %s, expected %s (use -f to proceed)", actual, expected)
+}
+
 func (m Migration) Apply(opts migrate.Options) error {
 	log.Verbose = opts.Verbose
 	log.Log("applying %s repo migration", m.Versions())
 
-	err := m.encodeDecode(
+	repoPath, v, err := resolveRepoPath(opts.Path)
+	if err != nil {
+		return err
+	}
+	opts.Path = repoPath
+
+	if v == toVersion {
+		log.Log("repo is already at version %s, nothing to do", toVersion)
+		return nil
+	}
+	if err := checkStartVersion(opts, v, fromVersion); err != nil {
+		return err
+	}
+
+	err = m.encodeDecode(
 		opts,
 		isEncoded, // skip if already encoded
 		encode,
@@ -68,11 +218,12 @@ func (m Migration) Apply(opts migrate.Options) error {
 		return err
 	}
 
-	err = mfsr.RepoPath(opts.Path).WriteVersion("9")
+	err = writeVersion(opts.Path, toVersion)
 	if err != nil {
-		log.Error("failed to update version file to 9")
+		log.Error("failed to update version file to %s", toVersion)
 		return err
 	}
+	m.logVersionTransition(opts.Path, v, toVersion)
 
 	log.Log("updated version file")
 
@@ -89,7 +240,7 @@ func (m Migration) encodeDecode(opts migrate.Options, shouldApplyCodec func(stri
 
 	for _, info := range fileInfos {
 		if info.IsDir() {
-			log.Log("skipping ", info.Name(), " as it is directory!")
+			log.Warn("skipping ", info.Name(), " as it is directory!")
 			continue
 		}
 
@@ -118,7 +269,17 @@ func (m Migration) Revert(opts migrate.Options) error {
 	log.Verbose = opts.Verbose
 	log.Log("reverting migration")
 
-	err := m.encodeDecode(
+	repoPath, v, err := resolveRepoPath(opts.Path)
+	if err != nil {
+		return err
+	}
+	opts.Path = repoPath
+
+	if err := checkStartVersion(opts, v, toVersion); err != nil {
+		return err
+	}
+
+	err = m.encodeDecode(
 		opts,
 		func(name string) bool {
 			return !isEncoded(name) // skip if not encoded
@@ -130,11 +291,12 @@ func (m Migration) Revert(opts migrate.Options) error {
 		return err
 	}
 
-	err = mfsr.RepoPath(opts.Path).WriteVersion("8")
+	err = writeVersion(opts.Path, fromVersion)
 	if err != nil {
-		log.Error("failed to update version file to 8")
+		log.Error("failed to update version file to %s", fromVersion)
 		return err
 	}
+	m.logVersionTransition(opts.Path, v, fromVersion)
 
 	log.Log("updated version file")
 
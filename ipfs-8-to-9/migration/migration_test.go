@@ -0,0 +1,408 @@
+package mg8
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	migrate "github.com/ipfs/fs-repo-migrations/go-migrate"
+	mfsr "github.com/ipfs/fs-repo-migrations/mfsr"
+	log "github.com/ipfs/fs-repo-migrations/stump"
+)
+
+// makeRepo creates a repo under dir with the given version file contents and
+// an empty keystore. An empty version means no version file is written.
+func makeRepo(t *testing.T, dir string, version string) string {
+	repo := filepath.Join(dir, "repo")
+	if err := os.MkdirAll(filepath.Join(repo, keystoreRoot), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if version != "" {
+		err := ioutil.WriteFile(filepath.Join(repo, mfsr.VersionFile), []byte(version), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return repo
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "mg8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Resolve the temp dir itself, as it may be a symlink on some systems.
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestResolveRepoPath(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	repo := makeRepo(t, dir, "8\n")
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(repo, link); err != nil {
+		t.Fatal(err)
+	}
+
+	resolved, v, err := resolveRepoPath(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved != repo {
+		t.Fatalf("expected %s to resolve to %s, got %s", link, repo, resolved)
+	}
+	if v != "8" {
+		t.Fatalf("expected version 8, got %q", v)
+	}
+}
+
+func TestResolveRepoPathDanglingSymlink(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(filepath.Join(dir, "missing"), link); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := resolveRepoPath(link); err == nil {
+		t.Fatal("expected an error resolving a dangling symlink")
+	}
+}
+
+func TestResolveRepoPathNoVersionFile(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	repo := makeRepo(t, dir, "")
+
+	_, _, err := resolveRepoPath(repo)
+	if _, ok := err.(mfsr.VersionFileNotFound); !ok {
+		t.Fatalf("expected mfsr.VersionFileNotFound, got %v", err)
+	}
+}
+
+func TestResolveRepoPathInvalidVersion(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	repo := makeRepo(t, dir, "8\n")
+	versionFile := mfsr.RepoPath(repo).VersionFile()
+
+	// An empty version file is what an interrupted truncate-and-write of
+	// the version would leave behind.
+	for _, contents := range []string{"", "\n", "nine\n"} {
+		if err := ioutil.WriteFile(versionFile, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		_, _, err := resolveRepoPath(repo)
+		if err == nil || !strings.Contains(err.Error(), "invalid version") {
+			t.Fatalf("version file %q: expected an invalid version error, got %v", contents, err)
+		}
+	}
+}
+
+func TestWriteVersionFile(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	repo := makeRepo(t, dir, "8\n")
+	if err := writeVersion(repo, "9"); err != nil {
+		t.Fatal(err)
+	}
+	checkVersion(t, repo, "9")
+
+	// Only the version file and the keystore are left, no temporary file.
+	infos, err := ioutil.ReadDir(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 {
+		t.Fatalf("expected 2 entries in repo, got %d", len(infos))
+	}
+}
+
+func TestResolveRepoPathNoKeystore(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	repo := makeRepo(t, dir, "8\n")
+	if err := os.Remove(filepath.Join(repo, keystoreRoot)); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err := resolveRepoPath(repo)
+	if err == nil || !strings.Contains(err.Error(), "no keystore directory") {
+		t.Fatalf("expected a missing keystore error, got %v", err)
+	}
+}
+
+// failVersionWrite makes every version file write fail until the returned
+// function is called.
+func failVersionWrite() func() {
+	orig := writeVersionFile
+	writeVersionFile = func(rp mfsr.RepoPath, version string) error {
+		return errors.New("simulated version write failure")
+	}
+	return func() { writeVersionFile = orig }
+}
+
+// captureLog redirects stump output into a buffer until the returned
+// function is called.
+func captureLog() (*bytes.Buffer, func()) {
+	buf := new(bytes.Buffer)
+	origLog, origErr, origWarn := log.LogOut, log.ErrOut, log.WarnOut
+	log.LogOut, log.ErrOut, log.WarnOut = buf, buf, buf
+	return buf, func() {
+		log.LogOut, log.ErrOut, log.WarnOut = origLog, origErr, origWarn
+	}
+}
+
+func TestApplyVersionReadBackMismatch(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	out, restoreLog := captureLog()
+	defer restoreLog()
+
+	// Write the old version when asked for the new one, so the write
+	// succeeds but the read-back disagrees.
+	orig := writeVersionFile
+	writeVersionFile = func(rp mfsr.RepoPath, version string) error {
+		return rp.WriteVersion("8")
+	}
+	defer func() { writeVersionFile = orig }()
+
+	repo := makeRepo(t, dir, "8\n")
+	err := Migration{}.Apply(migrate.Options{Flags: migrate.Flags{Path: repo}})
+	if err == nil || !strings.Contains(err.Error(), "versions differ") {
+		t.Fatalf("expected a versions differ error, got %v", err)
+	}
+	if strings.Contains(out.String(), "updated version file") {
+		t.Fatalf("Apply logged a version update that did not stick:\n%s", out.String())
+	}
+}
+
+func TestStartVersionCheck(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	_, restoreLog := captureLog()
+	defer restoreLog()
+
+	repo := makeRepo(t, dir, "7\n")
+	keyFile := filepath.Join(repo, keystoreRoot, "mykey")
+	if err := ioutil.WriteFile(keyFile, []byte("key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	opts := migrate.Options{Flags: migrate.Flags{Path: repo}}
+
+	// Neither direction touches a repo at an unexpected version.
+	if err := (Migration{}).Apply(opts); err == nil {
+		t.Fatal("expected Apply to refuse a repo at version 7")
+	}
+	if err := (Migration{}).Revert(opts); err == nil {
+		t.Fatal("expected Revert to refuse a repo at version 7")
+	}
+	checkVersion(t, repo, "7")
+	checkKeystore(t, repo, "mykey")
+
+	// -f skips the check.
+	opts.Force = true
+	if err := (Migration{}).Apply(opts); err != nil {
+		t.Fatal(err)
+	}
+	checkVersion(t, repo, "9")
+}
+
+// checkKeystore checks that the keystore holds exactly the given file names.
+func checkKeystore(t *testing.T, repo string, names ...string) {
+	infos, err := ioutil.ReadDir(filepath.Join(repo, keystoreRoot))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != len(names) {
+		t.Fatalf("expected %d keys in keystore, got %d", len(names), len(infos))
+	}
+	for i, info := range infos {
+		if info.Name() != names[i] {
+			t.Fatalf("expected key %s in keystore, got %s", names[i], info.Name())
+		}
+	}
+}
+
+func checkVersion(t *testing.T, repo string, version string) {
+	if err := mfsr.RepoPath(repo).CheckVersion(version); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVersionWriteFailureRecovery(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	_, restoreLog := captureLog()
+	defer restoreLog()
+
+	repo := makeRepo(t, dir, "8\n")
+	keyFile := filepath.Join(repo, keystoreRoot, "mykey")
+	if err := ioutil.WriteFile(keyFile, []byte("key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := encode("mykey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := migrate.Options{Flags: migrate.Flags{Path: repo}}
+
+	// A failed version write after the renames leaves the repo at 8 with
+	// the keys encoded, and a re-run completes the migration.
+	restore := failVersionWrite()
+	if err := (Migration{}).Apply(opts); err == nil {
+		t.Fatal("expected Apply to fail")
+	}
+	restore()
+	checkVersion(t, repo, "8")
+	checkKeystore(t, repo, encoded)
+
+	if err := (Migration{}).Apply(opts); err != nil {
+		t.Fatal(err)
+	}
+	checkVersion(t, repo, "9")
+	checkKeystore(t, repo, encoded)
+
+	// Same for Revert, in the other direction.
+	restore = failVersionWrite()
+	if err := (Migration{}).Revert(opts); err == nil {
+		t.Fatal("expected Revert to fail")
+	}
+	restore()
+	checkVersion(t, repo, "9")
+	checkKeystore(t, repo, "mykey")
+
+	if err := (Migration{}).Revert(opts); err != nil {
+		t.Fatal(err)
+	}
+	checkVersion(t, repo, "8")
+	checkKeystore(t, repo, "mykey")
+}
+
+func TestApplyAlreadyMigrated(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	out, restoreLog := captureLog()
+	defer restoreLog()
+
+	repo := makeRepo(t, dir, "9\n")
+	encoded, err := encode("mykey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(repo, keystoreRoot, encoded)
+	if err := ioutil.WriteFile(keyFile, []byte("key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := (Migration{}).Apply(migrate.Options{Flags: migrate.Flags{Path: repo}}); err != nil {
+		t.Fatal(err)
+	}
+	checkVersion(t, repo, "9")
+	checkKeystore(t, repo, encoded)
+	if !strings.Contains(out.String(), "already at version 9") {
+		t.Fatalf("expected Apply to log that the repo is already migrated:\n%s", out.String())
+	}
+}
+
+// lastVersionTransition returns the last version transition record in out.
+func lastVersionTransition(t *testing.T, out string) versionTransition {
+	const prefix = "version transition: "
+	var rec versionTransition
+	found := false
+	for _, line := range strings.Split(out, "\n") {
+		if !strings.HasPrefix(line, prefix) {
+			continue
+		}
+		if err := json.Unmarshal([]byte(line[len(prefix):]), &rec); err != nil {
+			t.Fatal(err)
+		}
+		found = true
+	}
+	if !found {
+		t.Fatalf("no version transition in log:\n%s", out)
+	}
+	return rec
+}
+
+func TestVersionTransitionLog(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	out, restoreLog := captureLog()
+	defer restoreLog()
+
+	repo := makeRepo(t, dir, "8\n")
+	opts := migrate.Options{Flags: migrate.Flags{Path: repo}}
+	before := time.Now().Add(-time.Second)
+
+	if err := (Migration{}).Apply(opts); err != nil {
+		t.Fatal(err)
+	}
+	rec := lastVersionTransition(t, out.String())
+	if rec.From != "8" || rec.To != "9" || rec.Migration != "8-to-9" || rec.Repo != repo {
+		t.Fatalf("unexpected Apply transition: %+v", rec)
+	}
+	if rec.Time.Before(before) {
+		t.Fatalf("transition time %s is before the run started", rec.Time)
+	}
+
+	if err := (Migration{}).Revert(opts); err != nil {
+		t.Fatal(err)
+	}
+	rec = lastVersionTransition(t, out.String())
+	if rec.From != "9" || rec.To != "8" {
+		t.Fatalf("unexpected Revert transition: %+v", rec)
+	}
+}
+
+func TestNeedsMigration(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		version string
+		needs   bool
+		err     bool
+	}{
+		{"7", false, false},
+		{"8", true, false},
+		{"9", false, false},
+		{"8\n", true, false},
+		{"", false, true}, // no version file
+	}
+
+	for i, tc := range tests {
+		repo := makeRepo(t, filepath.Join(dir, strconv.Itoa(i)), tc.version)
+
+		needs, err := Migration{}.NeedsMigration(migrate.Options{Flags: migrate.Flags{Path: repo}})
+		if tc.err != (err != nil) {
+			t.Fatalf("version %q: unexpected error value %v", tc.version, err)
+		}
+		if needs != tc.needs {
+			t.Fatalf("version %q: expected NeedsMigration to return %v, got %v", tc.version, tc.needs, needs)
+		}
+	}
+}
@@ -87,7 +87,7 @@ func convert(in io.Reader, out io.Writer, convBootstrap convArray, convAddresses
 func convertBootstrap(confMap map[string]interface{}, conv convArray) {
 	bootstrapi, _ := confMap["Bootstrap"].([]interface{})
 	if bootstrapi == nil {
-		log.Log("No Bootstrap field in config, skipping")
+		log.Warn("No Bootstrap field in config, skipping")
 		return
 	}
 	confMap["Bootstrap"] = conv(toStringArray(bootstrapi))
@@ -97,7 +97,7 @@ func convertBootstrap(confMap map[string]interface{}, conv convArray) {
 func convertAddresses(confMap map[string]interface{}, conv convAddrs) {
 	addressesi, _ := confMap["Addresses"].(map[string]interface{})
 	if addressesi == nil {
-		log.Log("Addresses field missing or of the wrong type")
+		log.Warn("Addresses field missing or of the wrong type")
 		return
 	}
 
@@ -11,13 +11,20 @@ var Verbose bool
 
 var ErrorPrefix = "ERROR: "
 
+var WarnPrefix = "WARNING: "
+
 var LogOut io.Writer = os.Stdout
 var ErrOut io.Writer = os.Stdout
+var WarnOut io.Writer = os.Stdout
 
 func Error(args ...interface{}) {
 	log(ErrOut, ErrorPrefix, args)
 }
 
+func Warn(args ...interface{}) {
+	log(WarnOut, WarnPrefix, args)
+}
+
 func Fatal(args ...interface{}) {
 	Error(args...)
 	os.Exit(1)